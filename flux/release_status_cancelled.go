@@ -0,0 +1,9 @@
+package flux
+
+// ReleaseStatusCancelled indicates that the release was cancelled --
+// e.g., fluxd received SIGTERM, or a user cancelled it via the API --
+// before a service update's outcome was known: either before the
+// service's turn came up, so it was never attempted, or while its apply
+// was still in flight, in which case that apply may still complete on
+// the platform.
+const ReleaseStatusCancelled ReleaseStatus = "cancelled"
@@ -0,0 +1,17 @@
+package flux
+
+// ServiceResult reports the outcome of releasing a single service.
+type ServiceResult struct {
+	Status       ReleaseStatus
+	Error        string
+	PerContainer []ContainerUpdate
+	// Batch is the index, starting at 0, of the ReleaseStrategy batch
+	// this service was applied in.
+	Batch int
+	// RolledBack is true if this service's batch failed its health
+	// check and was rolled back to its previous definition.
+	RolledBack bool
+}
+
+// ReleaseResult collects the per-service outcome of a release.
+type ReleaseResult map[ServiceID]ServiceResult
@@ -0,0 +1,19 @@
+package instance
+
+import (
+	"context"
+
+	"github.com/weaveworks/flux/platform"
+)
+
+// PlatformApplyWithContext applies defs to the platform, but first checks
+// ctx so a release that has already been cancelled -- by SIGTERM to
+// fluxd, or an explicit user cancel -- doesn't start new work. It does not
+// abort an apply once it has begun; callers that need to stop between
+// services should check ctx themselves between calls.
+func (inst *Instance) PlatformApplyWithContext(ctx context.Context, defs []platform.ServiceDefinition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return inst.PlatformApply(defs)
+}
@@ -0,0 +1,16 @@
+package platform
+
+import (
+	"context"
+
+	"github.com/weaveworks/flux"
+)
+
+// HealthChecker checks whether a service is healthy after a release
+// batch has been applied, so a release.ReleaseStrategy knows whether to
+// proceed to the next batch or roll back. Implementations typically
+// check pod readiness against the underlying orchestrator, or call a
+// user-supplied HTTP probe.
+type HealthChecker interface {
+	Healthy(ctx context.Context, id flux.ServiceID) error
+}
@@ -0,0 +1,11 @@
+package platform
+
+// RetryableError is satisfied by errors from a platform apply that are
+// transient -- for instance a dropped connection to the underlying
+// orchestrator, or a conflict that will clear on its own -- and so are
+// worth retrying. This is distinct from ApplyError, which reports a
+// definite, per-service failure that retrying won't fix.
+type RetryableError interface {
+	error
+	Retryable() bool
+}
@@ -0,0 +1,208 @@
+// Package xfer implements a concurrent, retrying scheduler for applying
+// service definitions to a platform. It is modeled on Docker's transfer
+// manager (docker/distribution/xfer): callers ask for a ServiceDefinition
+// to be applied and get back a Transfer they can wait on, concurrent
+// requests for the same service share a single in-flight Transfer, and
+// transient failures are retried with exponential backoff and jitter.
+package xfer
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/platform"
+)
+
+// ApplyFunc applies a single service definition to the platform.
+type ApplyFunc func(platform.ServiceDefinition) error
+
+// Status is the outcome of a Transfer.
+type Status int
+
+const (
+	StatusInProgress Status = iota
+	StatusDone
+	StatusFailed
+	StatusCancelled
+)
+
+// Transfer tracks a single in-flight (or completed) apply of a
+// ServiceDefinition. It is shared by every caller that asks to apply the
+// same ServiceID while it is in flight.
+type Transfer struct {
+	ServiceID flux.ServiceID
+
+	done chan struct{} // closed when the transfer finishes
+
+	mu       sync.Mutex
+	status   Status
+	err      error
+	refCount int
+	// started is true once run() has committed to actually calling
+	// apply(), i.e. once cancelling every reference can no longer skip
+	// the real work -- only report that nobody's waiting on it.
+	started bool
+}
+
+// Done returns a channel that is closed once the transfer has finished,
+// successfully or not.
+func (t *Transfer) Done() <-chan struct{} {
+	return t.done
+}
+
+// Result returns the outcome of a finished transfer. Only valid once
+// Done() has been closed.
+func (t *Transfer) Result() (Status, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status, t.err
+}
+
+// finish records the transfer's outcome and closes done, unless it has
+// already finished -- which happens whenever Cancel races with run()
+// actually completing, both of which call finish. Without this guard the
+// loser would close an already-closed channel and panic.
+func (t *Transfer) finish(status Status, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status != StatusInProgress {
+		return
+	}
+	t.status, t.err = status, err
+	close(t.done)
+}
+
+// TransferManager schedules ServiceDefinition applies with bounded
+// concurrency, deduplicates concurrent requests for the same ServiceID,
+// and retries transient (platform.RetryableError) failures.
+type TransferManager struct {
+	apply ApplyFunc
+	sem   chan struct{} // nil means unbounded concurrency
+
+	mu        sync.Mutex
+	transfers map[flux.ServiceID]*Transfer
+}
+
+// NewTransferManager creates a TransferManager that applies definitions
+// through fn, running up to concurrency applies at once. A concurrency of
+// zero or less means unbounded.
+func NewTransferManager(fn ApplyFunc, concurrency int) *TransferManager {
+	tm := &TransferManager{
+		apply:     fn,
+		transfers: map[flux.ServiceID]*Transfer{},
+	}
+	if concurrency > 0 {
+		tm.sem = make(chan struct{}, concurrency)
+	}
+	return tm
+}
+
+// Apply schedules def to be applied and returns its Transfer. If def's
+// ServiceID already has an apply in flight -- including one every caller
+// has since cancelled, but whose real apply can't be aborted and so is
+// still running -- the existing Transfer is returned instead, and its
+// reference count is bumped so that cancelling it again requires every
+// caller, including this one, to cancel.
+func (tm *TransferManager) Apply(def platform.ServiceDefinition) *Transfer {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if t, ok := tm.transfers[def.ServiceID]; ok {
+		t.mu.Lock()
+		t.refCount++
+		t.mu.Unlock()
+		return t
+	}
+	t := &Transfer{
+		ServiceID: def.ServiceID,
+		done:      make(chan struct{}),
+		refCount:  1,
+	}
+	tm.transfers[def.ServiceID] = t
+
+	go tm.run(t, def)
+	return t
+}
+
+// Cancel releases the caller's reference to the in-flight transfer for
+// id. If every caller that called Apply for it has also called Cancel,
+// and the real apply hasn't started yet, the Transfer is marked
+// StatusCancelled and removed without ever calling apply. Once the real
+// apply has started, though, there's no way to abort it (ApplyFunc takes
+// no context), so the transfer is left running and keeps its entry --
+// and its real eventual outcome -- for whoever calls Apply next to find.
+func (tm *TransferManager) Cancel(id flux.ServiceID) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t, ok := tm.transfers[id]
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	t.refCount--
+	cancelBeforeStart := t.refCount <= 0 && !t.started
+	t.mu.Unlock()
+
+	if cancelBeforeStart {
+		delete(tm.transfers, id)
+		t.finish(StatusCancelled, nil)
+	}
+}
+
+func (tm *TransferManager) run(t *Transfer, def platform.ServiceDefinition) {
+	if tm.sem != nil {
+		tm.sem <- struct{}{}
+		defer func() { <-tm.sem }()
+	}
+
+	tm.mu.Lock()
+	t.mu.Lock()
+	skip := t.refCount <= 0
+	if skip {
+		// Cancel may already have removed t, and a fresh Apply may have
+		// put a new Transfer under the same ServiceID since.
+		if tm.transfers[t.ServiceID] == t {
+			delete(tm.transfers, t.ServiceID)
+		}
+	} else {
+		t.started = true
+	}
+	t.mu.Unlock()
+	tm.mu.Unlock()
+
+	if skip {
+		// Every caller cancelled before we got as far as actually
+		// applying def, so there's nothing to abort -- just report it.
+		t.finish(StatusCancelled, nil)
+		return
+	}
+
+	const maxAttempts = 5
+	backoff := 500 * time.Millisecond
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = tm.apply(def)
+		if err == nil {
+			break
+		}
+		retryable, ok := err.(platform.RetryableError)
+		if !ok || !retryable.Retryable() {
+			break
+		}
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+
+	tm.mu.Lock()
+	delete(tm.transfers, t.ServiceID)
+	tm.mu.Unlock()
+
+	if err != nil {
+		t.finish(StatusFailed, err)
+		return
+	}
+	t.finish(StatusDone, nil)
+}
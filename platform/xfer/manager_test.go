@@ -0,0 +1,139 @@
+package xfer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/platform"
+)
+
+func TestTransferManager_DedupesInFlightApplies(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	block := make(chan struct{})
+	tm := NewTransferManager(func(def platform.ServiceDefinition) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-block
+		return nil
+	}, 0)
+
+	def := platform.ServiceDefinition{ServiceID: flux.ServiceID("default/foo")}
+	t1 := tm.Apply(def)
+	t2 := tm.Apply(def)
+	if t1 != t2 {
+		t.Fatal("expected Apply to return the same Transfer for an in-flight ServiceID")
+	}
+
+	close(block)
+	<-t1.Done()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Fatalf("expected apply to be called once, got %d", calls)
+	}
+}
+
+func TestTransferManager_CancelIsRefCounted(t *testing.T) {
+	started := make(chan struct{})
+	block := make(chan struct{})
+	tm := NewTransferManager(func(def platform.ServiceDefinition) error {
+		close(started)
+		<-block
+		return nil
+	}, 0)
+
+	def := platform.ServiceDefinition{ServiceID: flux.ServiceID("default/foo")}
+	t1 := tm.Apply(def)
+	tm.Apply(def) // a second reference to the same in-flight transfer
+	<-started     // make sure the real apply has begun before cancelling
+
+	tm.Cancel(def.ServiceID)
+	select {
+	case <-t1.Done():
+		t.Fatal("transfer finished after only one of two references was cancelled")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	tm.Cancel(def.ServiceID)
+	select {
+	case <-t1.Done():
+		t.Fatal("a transfer whose real apply has already started must run to completion, not finish early as Cancelled")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(block)
+	<-t1.Done()
+	if status, _ := t1.Result(); status != StatusDone {
+		t.Fatalf("expected StatusDone once the in-flight apply actually completed, got %v", status)
+	}
+}
+
+// TestTransferManager_CancelBeforeApplyStartsSkipsRealApply covers the
+// other half of the refCount-vs-real-apply race: if every caller cancels
+// before the real apply has begun, it must never begin at all, and the
+// ServiceID must be immediately available for a fresh Apply -- not left
+// pointing at a Transfer whose apply is still going to run unsupervised.
+func TestTransferManager_CancelBeforeApplyStartsSkipsRealApply(t *testing.T) {
+	busyStarted := make(chan struct{})
+	busyBlock := make(chan struct{})
+
+	var mu sync.Mutex
+	applied := map[flux.ServiceID]bool{}
+
+	tm := NewTransferManager(func(def platform.ServiceDefinition) error {
+		if def.ServiceID == flux.ServiceID("default/busy") {
+			close(busyStarted)
+			<-busyBlock
+			return nil
+		}
+		mu.Lock()
+		applied[def.ServiceID] = true
+		mu.Unlock()
+		return nil
+	}, 1) // concurrency 1, so "default/foo" can't start while "default/busy" holds the slot
+
+	tm.Apply(platform.ServiceDefinition{ServiceID: flux.ServiceID("default/busy")})
+	<-busyStarted // the only concurrency slot is now taken
+
+	def := platform.ServiceDefinition{ServiceID: flux.ServiceID("default/foo")}
+	tr := tm.Apply(def) // run() will block acquiring the slot, never reaching tm.apply
+
+	tm.Cancel(def.ServiceID)
+	<-tr.Done()
+	if status, _ := tr.Result(); status != StatusCancelled {
+		t.Fatalf("expected StatusCancelled for a transfer cancelled before it started, got %v", status)
+	}
+
+	close(busyBlock)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if applied[def.ServiceID] {
+		t.Fatal("apply ran for a transfer that was fully cancelled before it started")
+	}
+}
+
+func TestTransferManager_CancelAfterCompletionIsANoOp(t *testing.T) {
+	tm := NewTransferManager(func(def platform.ServiceDefinition) error {
+		return nil
+	}, 0)
+
+	def := platform.ServiceDefinition{ServiceID: flux.ServiceID("default/foo")}
+	tr := tm.Apply(def)
+	<-tr.Done()
+	if status, _ := tr.Result(); status != StatusDone {
+		t.Fatalf("expected StatusDone, got %v", status)
+	}
+
+	// A Cancel that arrives after the transfer already finished must not
+	// panic by closing Transfer.done a second time.
+	tm.Cancel(def.ServiceID)
+	if status, _ := tr.Result(); status != StatusDone {
+		t.Fatalf("a late Cancel must not change the outcome of a finished transfer, got %v", status)
+	}
+}
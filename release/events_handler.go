@@ -0,0 +1,67 @@
+package release
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// eventStreams tracks the JSONProgressWriter for each in-flight release,
+// keyed by release ID, so EventsHandler can find the right one to
+// subscribe to.
+var eventStreams = struct {
+	sync.Mutex
+	byID map[string]*JSONProgressWriter
+}{byID: map[string]*JSONProgressWriter{}}
+
+// registerEventStream makes w available to EventsHandler under id for the
+// duration of a release; the returned func deregisters it.
+func registerEventStream(id string, w *JSONProgressWriter) func() {
+	eventStreams.Lock()
+	eventStreams.byID[id] = w
+	eventStreams.Unlock()
+	return func() {
+		eventStreams.Lock()
+		delete(eventStreams.byID, id)
+		eventStreams.Unlock()
+	}
+}
+
+// EventsHandler serves GET /v1/release/{id}/events: it streams each
+// progress event for the named release as a line of JSON as it happens,
+// so fluxctl can render live per-service progress instead of polling for
+// a terminal result. releaseID extracts the {id} path variable from the
+// request, so this can be wired up under any router.
+func EventsHandler(releaseID func(*http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := releaseID(r)
+
+		eventStreams.Lock()
+		stream, ok := eventStreams.byID[id]
+		eventStreams.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		ch := make(chan ProgressEvent, 16)
+		stream.Subscribe(ch)
+
+		w.Header().Set("Content-Type", "application/json")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case event := <-ch:
+				if err := enc.Encode(event); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
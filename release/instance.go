@@ -1,14 +1,81 @@
 package release
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/weaveworks/flux"
 	"github.com/weaveworks/flux/instance"
 	"github.com/weaveworks/flux/platform"
+	"github.com/weaveworks/flux/platform/xfer"
 )
 
+// defaultStrategy is used when applyChanges isn't given one explicitly --
+// i.e., the existing, all-in-one-go behaviour.
+var defaultStrategy ReleaseStrategy = AllAtOnce{}
+
+// defaultConcurrentApplies bounds how many service updates a single
+// instance will have in flight against its platform at once, for callers
+// of applyChanges that don't request a concurrency of their own; it's the
+// "N" in the transfer manager's scheduling.
+const defaultConcurrentApplies = 10
+
+// transferManagers shares one TransferManager per platformInstance across
+// concurrent releases, so that two releases applying the same ServiceID
+// at the same time -- not just two services within one release -- can
+// actually hit the TransferManager's dedup path. Entries are reference
+// counted by acquireTransferManager/the release func it returns, and
+// removed once no release is currently using them, so an Instance that's
+// done releasing isn't kept reachable here for the life of the process.
+var transferManagers = struct {
+	sync.Mutex
+	byInstance map[platformInstance]*sharedTransferManager
+}{byInstance: map[platformInstance]*sharedTransferManager{}}
+
+type sharedTransferManager struct {
+	tm   *xfer.TransferManager
+	refs int
+}
+
+// acquireTransferManager returns the shared TransferManager for inst,
+// creating one -- with the given concurrency, or defaultConcurrentApplies
+// if concurrency isn't positive -- if this is the first caller currently
+// using it. concurrency is otherwise ignored once a manager for inst
+// exists: it's set once, by whichever release first acquires it.
+//
+// The returned release func must be called exactly once, when the caller
+// is done with the manager; the entry is evicted once every acquirer has
+// released it, so inst can be garbage collected once it's stopped being
+// released through.
+func acquireTransferManager(inst platformInstance, concurrency int) (tm *xfer.TransferManager, release func()) {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrentApplies
+	}
+
+	transferManagers.Lock()
+	s, ok := transferManagers.byInstance[inst]
+	if !ok {
+		s = &sharedTransferManager{tm: xfer.NewTransferManager(func(def platform.ServiceDefinition) error {
+			return inst.PlatformApply([]platform.ServiceDefinition{def})
+		}, concurrency)}
+		transferManagers.byInstance[inst] = s
+	}
+	s.refs++
+	transferManagers.Unlock()
+
+	return s.tm, func() {
+		transferManagers.Lock()
+		defer transferManagers.Unlock()
+		s.refs--
+		if s.refs <= 0 {
+			delete(transferManagers.byInstance, inst)
+		}
+	}
+}
+
 // Operations on instances (or instance.* types) that we need for
 // releasing
 
@@ -26,7 +93,10 @@ func LockedServices(config instance.Config) flux.ServiceIDSet {
 
 // CollectAvailableImages is a convenient shim to
 // `instance.CollectAvailableImages`.
-func CollectAvailableImages(inst *instance.Instance, updateable []*ServiceUpdate) (instance.ImageMap, error) {
+func CollectAvailableImages(ctx context.Context, inst platformInstance, updateable []*ServiceUpdate) (instance.ImageMap, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	var servicesToCheck []platform.Service
 	for _, update := range updateable {
 		servicesToCheck = append(servicesToCheck, update.Service)
@@ -34,28 +104,63 @@ func CollectAvailableImages(inst *instance.Instance, updateable []*ServiceUpdate
 	return inst.CollectAvailableImages(servicesToCheck)
 }
 
-// applyChanges effects the calculated changes on the platform.
-func applyChanges(inst *instance.Instance, updates []*ServiceUpdate, results flux.ReleaseResult) error {
-	// Collect definitions for each service release.
+// applyChanges effects the calculated changes on the platform, according
+// to strategy (a nil strategy behaves as AllAtOnce{}, the original,
+// single-batch behaviour). If ctx is cancelled -- by a SIGTERM to fluxd,
+// or an explicit user cancel from the API -- partway through, the
+// services not yet applied are marked flux.ReleaseStatusCancelled rather
+// than left to run; services already dispatched are left to complete.
+// The async self-update path (FluxServiceName/FluxDaemonName) is excluded
+// from cancellation once it's been dispatched, so that a graceful
+// shutdown still finishes recording what happened before the daemon
+// restarts. concurrency bounds how many services inst will have applying
+// at once; a non-positive concurrency uses defaultConcurrentApplies. It
+// only takes effect if no other release is already sharing inst's
+// TransferManager; see acquireTransferManager.
+func applyChanges(ctx context.Context, inst platformInstance, releaseID string, updates []*ServiceUpdate, strategy ReleaseStrategy, progress ProgressWriter, results flux.ReleaseResult, concurrency int) error {
+	if strategy == nil {
+		strategy = defaultStrategy
+	}
+	if progress == nil {
+		progress = NewLogEventProgressWriter(inst)
+	}
+
+	tm, release := acquireTransferManager(inst, concurrency)
+	defer release()
+
+	// Make this release's progress available over GET
+	// /v1/release/{releaseID}/events for the duration of the call, so
+	// fluxctl can stream it live instead of polling for a terminal
+	// result.
+	stream := &JSONProgressWriter{}
+	deregister := registerEventStream(releaseID, stream)
+	defer deregister()
+	progress = multiProgressWriter{progress, stream}
+
+	// Collect definitions for each service release, and the definition
+	// each service is running today, so a batch that fails its health
+	// check can be rolled back to it.
 	var defs []platform.ServiceDefinition
+	previous := map[flux.ServiceID][]byte{}
 	// If we're regrading our own image, we want to do that
 	// last, and "asynchronously" (meaning we probably won't
 	// see the reply).
 	var asyncDefs []platform.ServiceDefinition
 
 	for _, update := range updates {
-		namespace, serviceName := update.ServiceID.Components()
+		_, serviceName := update.ServiceID.Components()
 		updateMsg := summariseUpdate(update.Updates)
+		previous[update.ServiceID] = update.Service.Definition
 		switch serviceName {
 		case FluxServiceName, FluxDaemonName:
-			inst.LogEvent(namespace, serviceName, "Starting "+updateMsg+". (no result expected)")
+			progress.WriteProgress(update.ServiceID, StagePlanning, "Starting "+updateMsg+" (no result expected)", nil)
 			asyncDefs = append(asyncDefs, platform.ServiceDefinition{
 				ServiceID:     update.ServiceID,
 				NewDefinition: update.ManifestBytes,
 				Async:         true,
 			})
 		default:
-			inst.LogEvent(namespace, serviceName, "Starting "+updateMsg)
+			progress.WriteProgress(update.ServiceID, StagePlanning, "Starting "+updateMsg, nil)
 			defs = append(defs, platform.ServiceDefinition{
 				ServiceID:     update.ServiceID,
 				NewDefinition: update.ManifestBytes,
@@ -70,46 +175,40 @@ func applyChanges(inst *instance.Instance, updates []*ServiceUpdate, results flu
 		}
 	}
 
-	transactionErr := inst.PlatformApply(defs)
-	if transactionErr != nil {
-		switch err := transactionErr.(type) {
-		case platform.ApplyError:
-			for id, applyErr := range err {
-				results[id] = flux.ServiceResult{
-					Status: flux.ReleaseStatusFailed,
-					Error:  applyErr.Error(),
+	checker := strategy.Checker()
+	batches := strategy.Batches(defs)
+	for batchNum, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			markCancelled(progress, results, batch, err)
+			continue
+		}
+
+		applyBatch(ctx, inst, tm, progress, batch, batchNum, results)
+
+		if checker != nil {
+			// Bake, then check: give the batch strategy.Pause() (e.g. a
+			// canary's BakeTime) to settle before judging it healthy,
+			// rather than judging it the instant PlatformApply returns.
+			if pause := strategy.Pause(); pause > 0 {
+				select {
+				case <-time.After(pause):
+				case <-ctx.Done():
+					continue
 				}
 			}
-		default:
-			for _, update := range updates {
-				results[update.ServiceID] = flux.ServiceResult{
-					Status: flux.ReleaseStatusUnknown,
-					Error:  transactionErr.Error(),
-				}
+			for _, def := range batch {
+				progress.WriteProgress(def.ServiceID, StageVerifying, fmt.Sprintf("Batch %d: checking health", batchNum), nil)
+			}
+			if err := batchHealthy(ctx, checker, batch); err != nil {
+				rollbackBatch(ctx, inst, progress, batch, previous, results)
+				return fmt.Errorf("release rolled back: batch %d failed health check", batchNum)
+			}
+		} else if pause := strategy.Pause(); pause > 0 && batchNum < len(batches)-1 {
+			select {
+			case <-time.After(pause):
+			case <-ctx.Done():
+				continue
 			}
-			// assume everything that was planned failed, if there
-			// was a coverall error. Note that this _includes_ the
-			// async releases, since if there's a problem, we don't attempt
-			// them.
-			return transactionErr
-		}
-	}
-
-	// Report the results for the _synchronous_ updates.
-	for _, def := range defs { // this is our list of sync updates
-		result := results[def.ServiceID]
-		namespace, serviceName := def.ServiceID.Components()
-		updateMsg := summariseUpdate(result.PerContainer)
-		switch result.Status {
-		// these three cases should line up with the possibilities above
-		case flux.ReleaseStatusSuccess:
-			inst.LogEvent(namespace, serviceName, "Release "+updateMsg+" succeeded")
-		case flux.ReleaseStatusFailed:
-			inst.LogEvent(namespace, serviceName, "Release "+updateMsg+" failed: "+result.Error)
-		case flux.ReleaseStatusUnknown:
-			inst.LogEvent(namespace, serviceName, "Release "+updateMsg+" outcome unknown: "+result.Error)
-		default:
-			inst.Log("error", "unexpected release status", "service-id", def.ServiceID.String(), "status", string(result.Status))
 		}
 	}
 
@@ -121,10 +220,121 @@ func applyChanges(inst *instance.Instance, updates []*ServiceUpdate, results flu
 	// shutdown. So the only thing that goes missing is the
 	// result from this release call.
 	if len(asyncDefs) > 0 {
+		if err := ctx.Err(); err != nil {
+			markCancelled(progress, results, asyncDefs, err)
+			return nil
+		}
+		for _, def := range asyncDefs {
+			progress.WriteProgress(def.ServiceID, StageApplying, "Dispatching (no result expected)", nil)
+		}
 		inst.PlatformApply(asyncDefs)
 	}
 
-	return transactionErr
+	return nil
+}
+
+// applyBatch fans a single strategy batch out through tm instead of one
+// blocking PlatformApply call, so a handful of slow or flaky services in
+// the batch don't serialise it: each gets its own Transfer, deduplicated
+// by ServiceID and retried on transient errors, and we fan the results
+// back in here.
+func applyBatch(ctx context.Context, inst platformInstance, tm *xfer.TransferManager, progress ProgressWriter, batch []platform.ServiceDefinition, batchNum int, results flux.ReleaseResult) {
+	transfers := make(map[flux.ServiceID]*xfer.Transfer, len(batch))
+	for _, def := range batch {
+		progress.WriteProgress(def.ServiceID, StageApplying, fmt.Sprintf("Batch %d: applying", batchNum), nil)
+		transfers[def.ServiceID] = tm.Apply(def)
+	}
+
+	// Report the results for this batch as each of its transfers
+	// completes, or mark them cancelled without waiting if ctx is done --
+	// this is the only place a partially-applied batch is reported, so
+	// checking here between the apply and the report is what keeps the
+	// reported results accurate.
+	for _, def := range batch {
+		t := transfers[def.ServiceID]
+		result := results[def.ServiceID]
+
+		var status xfer.Status
+		var err error
+		select {
+		case <-t.Done():
+			status, err = t.Result()
+		case <-ctx.Done():
+			status, err = xfer.StatusCancelled, ctx.Err()
+		}
+		tm.Cancel(def.ServiceID)
+
+		switch status {
+		case xfer.StatusDone:
+			results[def.ServiceID] = flux.ServiceResult{
+				Status:       flux.ReleaseStatusSuccess,
+				PerContainer: result.PerContainer,
+				Batch:        batchNum,
+			}
+			progress.WriteProgress(def.ServiceID, StageSucceeded, fmt.Sprintf("Batch %d", batchNum), nil)
+		case xfer.StatusFailed:
+			results[def.ServiceID] = flux.ServiceResult{
+				Status: flux.ReleaseStatusFailed,
+				Error:  err.Error(),
+				Batch:  batchNum,
+			}
+			progress.WriteProgress(def.ServiceID, StageFailed, fmt.Sprintf("Batch %d", batchNum), err)
+		case xfer.StatusCancelled:
+			results[def.ServiceID] = flux.ServiceResult{
+				Status: flux.ReleaseStatusCancelled,
+				Error:  err.Error(),
+				Batch:  batchNum,
+			}
+			progress.WriteProgress(def.ServiceID, StageSkipped, fmt.Sprintf("Batch %d: cancelled", batchNum), err)
+		default:
+			inst.Log("error", "unexpected transfer status", "service-id", def.ServiceID.String(), "status", status)
+		}
+	}
+}
+
+// batchHealthy consults checker for every service in batch, returning the
+// first error encountered (or nil if the whole batch is healthy).
+func batchHealthy(ctx context.Context, checker platform.HealthChecker, batch []platform.ServiceDefinition) error {
+	for _, def := range batch {
+		if err := checker.Healthy(ctx, def.ServiceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackBatch re-applies each service's previous definition, captured
+// before the release began, and marks the batch's results accordingly.
+func rollbackBatch(ctx context.Context, inst platformInstance, progress ProgressWriter, batch []platform.ServiceDefinition, previous map[flux.ServiceID][]byte, results flux.ReleaseResult) {
+	for _, def := range batch {
+		result := results[def.ServiceID]
+		result.Status = flux.ReleaseStatusFailed
+		if err := inst.PlatformApplyWithContext(ctx, []platform.ServiceDefinition{{
+			ServiceID:     def.ServiceID,
+			NewDefinition: previous[def.ServiceID],
+		}}); err != nil {
+			result.Error = "failed health check, and rollback failed: " + err.Error()
+			progress.WriteProgress(def.ServiceID, StageFailed, "Rollback failed", err)
+		} else {
+			result.RolledBack = true
+			result.Error = "failed health check, rolled back"
+			progress.WriteProgress(def.ServiceID, StageFailed, "Rolled back after failed health check", nil)
+		}
+		results[def.ServiceID] = result
+	}
+}
+
+// markCancelled marks every service in batch as cancelled without
+// attempting to apply it, for batches whose turn came up after ctx was
+// already done.
+func markCancelled(progress ProgressWriter, results flux.ReleaseResult, batch []platform.ServiceDefinition, err error) {
+	for _, def := range batch {
+		results[def.ServiceID] = flux.ServiceResult{
+			Status: flux.ReleaseStatusCancelled,
+			Error:  err.Error(),
+		}
+		progress.WriteProgress(def.ServiceID, StageSkipped, "Release cancelled", err)
+	}
 }
 
 func summariseUpdate(containerUpdates []flux.ContainerUpdate) string {
@@ -136,4 +346,4 @@ func summariseUpdate(containerUpdates []flux.ContainerUpdate) string {
 		individualUpdates = append(individualUpdates, fmt.Sprintf("%s (%s -> %s)", c.Container, c.Current, c.Target.Tag))
 	}
 	return strings.Join(individualUpdates, ", ")
-}
\ No newline at end of file
+}
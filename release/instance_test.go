@@ -0,0 +1,112 @@
+package release
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/instance"
+	"github.com/weaveworks/flux/platform"
+)
+
+// fakePlatform is a platformInstance whose PlatformApply and
+// PlatformApplyWithContext both block on a channel until the test releases
+// it, so tests can control exactly when an in-flight apply completes
+// relative to a context cancellation. applyBatch applies through the
+// shared TransferManager, which only ever calls PlatformApply, but
+// rollbackBatch still calls PlatformApplyWithContext directly, so both
+// need to block the same way.
+type fakePlatform struct {
+	block chan struct{}
+
+	mu     sync.Mutex
+	events []string
+}
+
+func newFakePlatform(block chan struct{}) *fakePlatform {
+	return &fakePlatform{block: block}
+}
+
+func (f *fakePlatform) PlatformApply(defs []platform.ServiceDefinition) error {
+	<-f.block
+	return nil
+}
+
+func (f *fakePlatform) PlatformApplyWithContext(ctx context.Context, defs []platform.ServiceDefinition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	<-f.block
+	return nil
+}
+
+func (f *fakePlatform) CollectAvailableImages(services []platform.Service) (instance.ImageMap, error) {
+	return nil, nil
+}
+
+func (f *fakePlatform) LogEvent(namespace, service, msg string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, msg)
+}
+
+func (f *fakePlatform) Log(keyvals ...interface{}) error { return nil }
+
+func testUpdates(id flux.ServiceID) []*ServiceUpdate {
+	return []*ServiceUpdate{{
+		ServiceID:     id,
+		ManifestBytes: []byte("new"),
+		Service:       platform.Service{Definition: []byte("old")},
+	}}
+}
+
+func TestApplyChanges_AlreadyCancelledMarksServicesCancelled(t *testing.T) {
+	inst := newFakePlatform(make(chan struct{})) // never unblocked: apply must not be attempted
+
+	id := flux.ServiceID("default/foo")
+	results := flux.ReleaseResult{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := applyChanges(ctx, inst, "release-1", testUpdates(id), AllAtOnce{}, nil, results, 0); err != nil {
+		t.Fatalf("applyChanges returned an error: %v", err)
+	}
+
+	if got := results[id].Status; got != flux.ReleaseStatusCancelled {
+		t.Fatalf("expected ReleaseStatusCancelled, got %v", got)
+	}
+}
+
+func TestApplyChanges_CancelWhileApplyInFlight(t *testing.T) {
+	block := make(chan struct{})
+	inst := newFakePlatform(block)
+	defer close(block)
+
+	id := flux.ServiceID("default/foo")
+	results := flux.ReleaseResult{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- applyChanges(ctx, inst, "release-1", testUpdates(id), AllAtOnce{}, nil, results, 0) }()
+
+	// give the apply a moment to start and block, then cancel while it's
+	// still in flight
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("applyChanges returned an error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("applyChanges did not return after cancellation")
+	}
+
+	if got := results[id].Status; got != flux.ReleaseStatusCancelled {
+		t.Fatalf("expected ReleaseStatusCancelled, got %v", got)
+	}
+}
@@ -0,0 +1,22 @@
+package release
+
+import (
+	"context"
+
+	"github.com/weaveworks/flux/instance"
+	"github.com/weaveworks/flux/platform"
+)
+
+// platformInstance is the subset of *instance.Instance that this package
+// needs in order to apply a release. It exists so applyChanges and its
+// helpers can be exercised in tests against a fake, rather than a real
+// instance.Instance.
+type platformInstance interface {
+	PlatformApply(defs []platform.ServiceDefinition) error
+	PlatformApplyWithContext(ctx context.Context, defs []platform.ServiceDefinition) error
+	CollectAvailableImages(services []platform.Service) (instance.ImageMap, error)
+	LogEvent(namespace, service, msg string)
+	Log(keyvals ...interface{}) error
+}
+
+var _ platformInstance = (*instance.Instance)(nil)
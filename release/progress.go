@@ -0,0 +1,111 @@
+package release
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/weaveworks/flux"
+)
+
+// Stage is where a single service is in the lifecycle of a release.
+type Stage string
+
+const (
+	StagePlanning  Stage = "Planning"
+	StageApplying  Stage = "Applying"
+	StageVerifying Stage = "Verifying"
+	StageSucceeded Stage = "Succeeded"
+	StageFailed    Stage = "Failed"
+	StageSkipped   Stage = "Skipped"
+)
+
+// ProgressWriter receives progress events for individual services during
+// a release, so callers such as fluxctl can render live per-service
+// progress instead of polling for a terminal result.
+type ProgressWriter interface {
+	WriteProgress(id flux.ServiceID, stage Stage, message string, err error)
+}
+
+// logEventProgressWriter is the default ProgressWriter: it adapts
+// progress events onto the event log, which is what applyChanges has
+// always recorded its progress through.
+type logEventProgressWriter struct {
+	inst platformInstance
+}
+
+// NewLogEventProgressWriter returns a ProgressWriter that records
+// progress via inst.LogEvent.
+func NewLogEventProgressWriter(inst platformInstance) ProgressWriter {
+	return &logEventProgressWriter{inst: inst}
+}
+
+func (w *logEventProgressWriter) WriteProgress(id flux.ServiceID, stage Stage, message string, err error) {
+	namespace, serviceName := id.Components()
+	text := string(stage) + ": " + message
+	if err != nil {
+		text += ": " + err.Error()
+	}
+	w.inst.LogEvent(namespace, serviceName, text)
+}
+
+// multiProgressWriter fans a progress event out to several ProgressWriters.
+type multiProgressWriter []ProgressWriter
+
+func (m multiProgressWriter) WriteProgress(id flux.ServiceID, stage Stage, message string, err error) {
+	for _, w := range m {
+		w.WriteProgress(id, stage, message, err)
+	}
+}
+
+// ProgressEvent is the JSON-line wire format for a progress event, as
+// served by JSONProgressWriter and the events HTTP endpoint.
+type ProgressEvent struct {
+	ServiceID flux.ServiceID `json:"serviceID"`
+	Stage     Stage          `json:"stage"`
+	Message   string         `json:"message"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// JSONProgressWriter writes each progress event as a line of JSON to Out
+// (if set), and fans it out to any channels registered with Subscribe --
+// in particular the /v1/release/{id}/events HTTP handler, so that it can
+// stream events to fluxctl as they happen.
+type JSONProgressWriter struct {
+	Out io.Writer
+
+	mu          sync.Mutex
+	subscribers []chan ProgressEvent
+}
+
+// Subscribe registers ch to receive every subsequent progress event.
+// Events are dropped rather than blocking the release if ch isn't drained
+// promptly.
+func (w *JSONProgressWriter) Subscribe(ch chan ProgressEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers = append(w.subscribers, ch)
+}
+
+func (w *JSONProgressWriter) WriteProgress(id flux.ServiceID, stage Stage, message string, err error) {
+	event := ProgressEvent{ServiceID: id, Stage: stage, Message: message}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	w.mu.Lock()
+	subscribers := append([]chan ProgressEvent(nil), w.subscribers...)
+	w.mu.Unlock()
+	for _, ch := range subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+
+	if w.Out != nil {
+		if line, marshalErr := json.Marshal(event); marshalErr == nil {
+			w.Out.Write(append(line, '\n'))
+		}
+	}
+}
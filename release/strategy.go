@@ -0,0 +1,119 @@
+package release
+
+import (
+	"time"
+
+	"github.com/weaveworks/flux/platform"
+)
+
+// ReleaseStrategy controls how applyChanges partitions a release's
+// service definitions into batches, how long it pauses between them, and
+// which platform.HealthChecker (if any) gates moving on to the next
+// batch.
+type ReleaseStrategy interface {
+	// Batches splits defs into the sequence of batches to apply.
+	Batches(defs []platform.ServiceDefinition) [][]platform.ServiceDefinition
+	// Pause is how long to wait after a batch is applied. With a non-nil
+	// Checker, the wait comes before that batch's health check, and
+	// follows every batch, the last included; with a nil Checker, it
+	// only comes between one batch and the next.
+	Pause() time.Duration
+	// Checker is consulted after each batch is applied; a nil Checker
+	// means the batch is trusted as soon as PlatformApply returns.
+	Checker() platform.HealthChecker
+}
+
+// AllAtOnce applies every service definition in a single batch, with no
+// health check between batches. This is the strategy applyChanges has
+// always used.
+type AllAtOnce struct{}
+
+func (AllAtOnce) Batches(defs []platform.ServiceDefinition) [][]platform.ServiceDefinition {
+	return singleBatch(defs)
+}
+
+func (AllAtOnce) Pause() time.Duration { return 0 }
+
+func (AllAtOnce) Checker() platform.HealthChecker { return nil }
+
+// Rolling applies defs in batches of BatchSize, pausing PauseBetween
+// batches and consulting HealthCheck before proceeding to the next one.
+type Rolling struct {
+	BatchSize    int
+	PauseBetween time.Duration
+	HealthCheck  platform.HealthChecker
+}
+
+func (r Rolling) Batches(defs []platform.ServiceDefinition) [][]platform.ServiceDefinition {
+	if len(defs) == 0 {
+		return nil
+	}
+	size := r.BatchSize
+	if size <= 0 {
+		size = len(defs)
+	}
+	var batches [][]platform.ServiceDefinition
+	for i := 0; i < len(defs); i += size {
+		end := i + size
+		if end > len(defs) {
+			end = len(defs)
+		}
+		batches = append(batches, defs[i:end])
+	}
+	return batches
+}
+
+func (r Rolling) Pause() time.Duration { return r.PauseBetween }
+
+func (r Rolling) Checker() platform.HealthChecker { return r.HealthCheck }
+
+// Canary applies Percent of defs first, bakes for BakeTime, then -- once
+// Promote confirms the canary batch is healthy -- applies the rest in a
+// second batch.
+type Canary struct {
+	Percent  int
+	BakeTime time.Duration
+	Promote  platform.HealthChecker
+}
+
+func (c Canary) Batches(defs []platform.ServiceDefinition) [][]platform.ServiceDefinition {
+	if len(defs) == 0 {
+		return nil
+	}
+	n := len(defs) * c.Percent / 100
+	if n <= 0 {
+		n = 1
+	}
+	if n >= len(defs) {
+		return singleBatch(defs)
+	}
+	return [][]platform.ServiceDefinition{defs[:n], defs[n:]}
+}
+
+func (c Canary) Pause() time.Duration { return c.BakeTime }
+
+func (c Canary) Checker() platform.HealthChecker { return c.Promote }
+
+// BlueGreen applies every service definition in a single batch, as
+// AllAtOnce does. VerifyTimeout is returned as its Pause, but BlueGreen
+// has no Checker, and applyChanges only pauses between batches when there
+// is no Checker, so with its single batch the release neither waits for
+// VerifyTimeout nor verifies the new ("green") version.
+type BlueGreen struct {
+	VerifyTimeout time.Duration
+}
+
+func (bg BlueGreen) Batches(defs []platform.ServiceDefinition) [][]platform.ServiceDefinition {
+	return singleBatch(defs)
+}
+
+func (bg BlueGreen) Pause() time.Duration { return bg.VerifyTimeout }
+
+func (bg BlueGreen) Checker() platform.HealthChecker { return nil }
+
+func singleBatch(defs []platform.ServiceDefinition) [][]platform.ServiceDefinition {
+	if len(defs) == 0 {
+		return nil
+	}
+	return [][]platform.ServiceDefinition{defs}
+}